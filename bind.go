@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// deviceListenConfig returns a net.ListenConfig that binds any socket it
+// opens to device via SO_BINDTODEVICE before the kernel performs bind(2).
+// This lets several listeners share the same address (e.g. the metadata
+// server's 169.254.169.254:80) as long as each is scoped to a different tap
+// interface.
+func deviceListenConfig(device string) *net.ListenConfig {
+	return &net.ListenConfig{
+		Control: func(_, _ string, c syscall.RawConn) error {
+			return controlBindToDevice(c, device)
+		},
+	}
+}
+
+func controlBindToDevice(c syscall.RawConn, device string) error {
+	var opErr error
+	if err := c.Control(func(fd uintptr) {
+		opErr = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, device)
+	}); err != nil {
+		return err
+	}
+	return opErr
+}
+
+// bindToDevice scopes an already-open PacketConn to device. The raw sockets
+// (DHCPv4, RA) are opened with net.ListenPacket, not deviceListenConfig, and
+// are scoped with this after they are bound.
+func bindToDevice(conn net.PacketConn, device string) error {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return fmt.Errorf("bindToDevice: %T has no SyscallConn", conn)
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	return controlBindToDevice(rc, device)
+}
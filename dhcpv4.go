@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+
+	"code.google.com/p/go.net/ipv4"
+	"github.com/golang/glog"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+const (
+	dhcpServerPort = 67
+	dhcpClientPort = 68
+)
+
+// dhcpv4Addr returns the host ipv4 address this domain should be handed out
+// over DHCPv4, or nil if none is configured.
+func (s *Server) dhcpv4Addr() *IP {
+	if s.metadata == nil {
+		return nil
+	}
+	for i, addr := range s.metadata.Network.IP {
+		if addr.Family == "ipv4" && addr.Host == "true" {
+			return &s.metadata.Network.IP[i]
+		}
+	}
+	return nil
+}
+
+// ListenAndServeUDPv4 answers DHCPv4 DISCOVER/REQUEST on UDP/67, bound to
+// this guest's tap device, handing out the ipv4 address from the domain's
+// libvirt metadata. Replies go out over a raw IP socket and are broadcast,
+// since a freshly booting guest has no configured address to unicast to.
+func (s *Server) ListenAndServeUDPv4() error {
+	pc, err := net.ListenPacket("ip4:udp", "0.0.0.0")
+	if err != nil {
+		return err
+	}
+	if err := bindToDevice(pc, "tap"+s.name); err != nil {
+		pc.Close()
+		return err
+	}
+
+	rawConn, err := ipv4.NewRawConn(pc)
+	if err != nil {
+		pc.Close()
+		return err
+	}
+
+	s.Lock()
+	s.ipv4conn = rawConn
+	s.Unlock()
+
+	buf := make([]byte, 1500)
+	for {
+		_, payload, _, err := rawConn.ReadFrom(buf)
+		if err != nil {
+			if s.shutdown {
+				return nil
+			}
+			glog.Errorf("%s dhcpv4 read: %v", s.name, err)
+			continue
+		}
+
+		udpPayload, _, dstPort, err := parseUDP(payload)
+		if err != nil || dstPort != dhcpServerPort {
+			continue
+		}
+
+		req, err := dhcpv4.FromBytes(udpPayload)
+		if err != nil {
+			glog.Errorf("%s dhcpv4 parse: %v", s.name, err)
+			continue
+		}
+
+		resp, err := s.dhcpv4Reply(req)
+		if err != nil {
+			glog.Errorf("%s dhcpv4 reply: %v", s.name, err)
+			continue
+		}
+		if resp == nil {
+			continue
+		}
+
+		if err := s.sendDHCPv4Reply(rawConn, resp); err != nil {
+			glog.Errorf("%s dhcpv4 write: %v", s.name, err)
+		}
+	}
+}
+
+// dhcpv4Reply builds the OFFER/ACK for a DISCOVER/REQUEST, advertising this
+// process's embedded resolver via option 6. It returns nil, nil when there is
+// nothing to answer: no ipv4 host address is configured, or the message is
+// neither a DISCOVER nor a REQUEST.
+func (s *Server) dhcpv4Reply(req *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, error) {
+	addr := s.dhcpv4Addr()
+	if addr == nil {
+		return nil, nil
+	}
+
+	yourIP := net.ParseIP(addr.Address)
+	if yourIP == nil {
+		return nil, fmt.Errorf("dhcpv4: invalid address %s", addr.Address)
+	}
+
+	prefix, err := strconv.Atoi(addr.Prefix)
+	if err != nil {
+		return nil, fmt.Errorf("dhcpv4: invalid prefix %s: %v", addr.Prefix, err)
+	}
+
+	modifiers := []dhcpv4.Modifier{
+		dhcpv4.WithYourIP(yourIP),
+		dhcpv4.WithNetmask(net.CIDRMask(prefix, 32)),
+		dhcpv4.WithDNS(dnsServerIPv4List()...),
+		dhcpv4.WithLeaseTime(uint32(dhcpv6LeaseTime.Seconds())),
+	}
+	if addr.Gateway != "" {
+		if gw := net.ParseIP(addr.Gateway); gw != nil {
+			modifiers = append(modifiers, dhcpv4.WithRouter(gw))
+		}
+	}
+	if s.hostIP != nil {
+		modifiers = append(modifiers, dhcpv4.WithOption(dhcpv4.OptServerIdentifier(s.hostIP)))
+	}
+
+	switch req.MessageType() {
+	case dhcpv4.MessageTypeDiscover:
+		modifiers = append(modifiers, dhcpv4.WithMessageType(dhcpv4.MessageTypeOffer))
+	case dhcpv4.MessageTypeRequest:
+		modifiers = append(modifiers, dhcpv4.WithMessageType(dhcpv4.MessageTypeAck))
+	default:
+		return nil, nil
+	}
+
+	return dhcpv4.NewReplyFromRequest(req, modifiers...)
+}
+
+// dnsServerIPv4List parses dnsServerIPs() into the subset that are IPv4
+// addresses, for use with dhcpv4.WithDNS (option 6), silently dropping any
+// that fail to parse.
+func dnsServerIPv4List() []net.IP {
+	var ips []net.IP
+	for _, addr := range dnsServerIPs() {
+		ip := net.ParseIP(addr)
+		if ip == nil || ip.To4() == nil {
+			continue
+		}
+		ips = append(ips, ip)
+	}
+	return ips
+}
+
+// sendDHCPv4Reply wraps resp in a UDP datagram (server port 67 -> client
+// port 68) and broadcasts it as a raw IPv4 packet from this hypervisor's
+// own address.
+func (s *Server) sendDHCPv4Reply(rawConn *ipv4.RawConn, resp *dhcpv4.DHCPv4) error {
+	payload := resp.ToBytes()
+	udpLen := 8 + len(payload)
+
+	udp := make([]byte, udpLen)
+	binary.BigEndian.PutUint16(udp[0:2], dhcpServerPort)
+	binary.BigEndian.PutUint16(udp[2:4], dhcpClientPort)
+	binary.BigEndian.PutUint16(udp[4:6], uint16(udpLen))
+	// udp[6:8] checksum left zero: optional for IPv4 UDP per RFC 768.
+	copy(udp[8:], payload)
+
+	header := &ipv4.Header{
+		Version:  4,
+		Len:      ipv4.HeaderLen,
+		TotalLen: ipv4.HeaderLen + udpLen,
+		TTL:      64,
+		Protocol: 17, // UDP
+		Dst:      net.IPv4bcast,
+		Src:      s.hostIP,
+	}
+
+	return rawConn.WriteTo(header, udp, nil)
+}
+
+// parseUDP splits a raw IPv4 payload into the UDP payload and the
+// src/dst ports of its UDP header.
+func parseUDP(b []byte) (payload []byte, srcPort, dstPort uint16, err error) {
+	if len(b) < 8 {
+		return nil, 0, 0, fmt.Errorf("dhcpv4: short udp datagram (%d bytes)", len(b))
+	}
+	srcPort = binary.BigEndian.Uint16(b[0:2])
+	dstPort = binary.BigEndian.Uint16(b[2:4])
+	length := binary.BigEndian.Uint16(b[4:6])
+	if int(length) > len(b) || length < 8 {
+		return nil, 0, 0, fmt.Errorf("dhcpv4: invalid udp length %d", length)
+	}
+	return b[8:length], srcPort, dstPort, nil
+}
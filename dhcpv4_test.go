@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+func TestDhcpv4AddrSelectsHostIPv4(t *testing.T) {
+	s := &Server{metadata: &Metadata{Network: Network{IP: []IP{
+		{Family: "ipv6", Address: "2001:db8::10", Host: "true", Prefix: "64"},
+		{Family: "ipv4", Address: "192.0.2.10", Host: "true", Prefix: "24"},
+	}}}}
+
+	addr := s.dhcpv4Addr()
+	if addr == nil || addr.Address != "192.0.2.10" {
+		t.Fatalf("expected the host ipv4 address, got %+v", addr)
+	}
+}
+
+func TestDhcpv4AddrNoneConfigured(t *testing.T) {
+	s := &Server{metadata: &Metadata{Network: Network{IP: []IP{
+		{Family: "ipv4", Address: "192.0.2.10", Host: "false", Prefix: "24"},
+	}}}}
+
+	if addr := s.dhcpv4Addr(); addr != nil {
+		t.Fatalf("expected no address, got %+v", addr)
+	}
+}
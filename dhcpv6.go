@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+// dhcpv6LeaseTime is the preferred/valid lifetime handed out for DHCPv6
+// addresses. RENEW and REBIND messages are not answered (see dhcpv6Reply).
+const dhcpv6LeaseTime = 2 * time.Hour
+
+// dhcpv6Addr returns the first host ipv6 address this domain should be
+// handed out over DHCPv6, or nil if none is configured.
+func (s *Server) dhcpv6Addr() *IP {
+	if s.metadata == nil {
+		return nil
+	}
+	for i, addr := range s.metadata.Network.IP {
+		if addr.Family == "ipv6" && addr.Host == "true" {
+			return &s.metadata.Network.IP[i]
+		}
+	}
+	return nil
+}
+
+// ListenAndServeUDPv6 answers DHCPv6 SOLICIT/REQUEST/INFORMATION-REQUEST on
+// UDP/547, bound to this guest's tap device, handing out the ipv6 address
+// from the domain's libvirt metadata.
+func (s *Server) ListenAndServeUDPv6() error {
+	lc := deviceListenConfig("tap" + s.name)
+	pc, err := lc.ListenPacket(context.Background(), "udp6", fmt.Sprintf(":%d", dhcpv6.DefaultServerPort))
+	if err != nil {
+		return err
+	}
+	conn, ok := pc.(*net.UDPConn)
+	if !ok {
+		pc.Close()
+		return fmt.Errorf("dhcpv6: unexpected conn type %T", pc)
+	}
+
+	s.Lock()
+	s.ipv6dhcpconn = conn
+	s.Unlock()
+
+	buf := make([]byte, 4096)
+	for {
+		n, peer, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if s.shutdown {
+				return nil
+			}
+			glog.Errorf("%s dhcpv6 read: %v", s.name, err)
+			continue
+		}
+
+		req, err := dhcpv6.MessageFromBytes(buf[:n])
+		if err != nil {
+			glog.Errorf("%s dhcpv6 parse: %v", s.name, err)
+			continue
+		}
+
+		resp, err := s.dhcpv6Reply(req)
+		if err != nil {
+			glog.Errorf("%s dhcpv6 reply: %v", s.name, err)
+			continue
+		}
+		if resp == nil {
+			continue
+		}
+
+		if _, err := conn.WriteToUDP(resp.ToBytes(), peer); err != nil {
+			glog.Errorf("%s dhcpv6 write: %v", s.name, err)
+		}
+	}
+}
+
+// dhcpv6Reply builds the ADVERTISE/REPLY for a SOLICIT/REQUEST, or the REPLY
+// for an INFORMATION-REQUEST. It returns nil, nil when there is nothing to
+// answer: a SOLICIT/REQUEST with no ipv6 host address configured, or any
+// other message type.
+func (s *Server) dhcpv6Reply(req dhcpv6.DHCPv6) (dhcpv6.DHCPv6, error) {
+	addr := s.dhcpv6Addr()
+
+	switch req.Type() {
+	case dhcpv6.MessageTypeInformationRequest:
+		return dhcpv6.NewReplyFromMessage(req.(*dhcpv6.Message))
+
+	case dhcpv6.MessageTypeSolicit:
+		if addr == nil {
+			return nil, nil
+		}
+		iaaddr, err := addr.dhcpv6IAAddress()
+		if err != nil {
+			return nil, err
+		}
+		return dhcpv6.NewAdvertiseFromSolicit(req, dhcpv6.WithIAAddress(iaaddr))
+
+	case dhcpv6.MessageTypeRequest:
+		if addr == nil {
+			return nil, nil
+		}
+		iaaddr, err := addr.dhcpv6IAAddress()
+		if err != nil {
+			return nil, err
+		}
+		return dhcpv6.NewReplyFromMessage(req.(*dhcpv6.Message), dhcpv6.WithIAAddress(iaaddr))
+	}
+
+	return nil, nil
+}
+
+func (ip *IP) dhcpv6IAAddress() (*dhcpv6.OptIAAddress, error) {
+	addr := net.ParseIP(ip.Address)
+	if addr == nil {
+		return nil, errInvalidAddress(ip.Address)
+	}
+	return &dhcpv6.OptIAAddress{IPv6Addr: addr, PreferredLifetime: dhcpv6LeaseTime, ValidLifetime: dhcpv6LeaseTime}, nil
+}
+
+func errInvalidAddress(addr string) error {
+	return &net.ParseError{Type: "IP address", Text: addr}
+}
@@ -0,0 +1,45 @@
+package main
+
+import "testing"
+
+func TestDhcpv6AddrSelectsHostIPv6(t *testing.T) {
+	s := &Server{metadata: &Metadata{Network: Network{IP: []IP{
+		{Family: "ipv4", Address: "192.0.2.10", Host: "true"},
+		{Family: "ipv6", Address: "2001:db8::10", Host: "true", Prefix: "64"},
+	}}}}
+
+	addr := s.dhcpv6Addr()
+	if addr == nil || addr.Address != "2001:db8::10" {
+		t.Fatalf("expected the host ipv6 address, got %+v", addr)
+	}
+}
+
+func TestDhcpv6AddrNoneConfigured(t *testing.T) {
+	s := &Server{metadata: &Metadata{Network: Network{IP: []IP{
+		{Family: "ipv6", Address: "2001:db8::10", Host: "false", Prefix: "64"},
+	}}}}
+
+	if addr := s.dhcpv6Addr(); addr != nil {
+		t.Fatalf("expected no address, got %+v", addr)
+	}
+}
+
+func TestDhcpv6IAAddressInvalid(t *testing.T) {
+	ip := &IP{Address: "not-an-ip"}
+
+	if _, err := ip.dhcpv6IAAddress(); err == nil {
+		t.Fatal("expected an error for an invalid address")
+	}
+}
+
+func TestDhcpv6IAAddressValid(t *testing.T) {
+	ip := &IP{Address: "2001:db8::10"}
+
+	iaaddr, err := ip.dhcpv6IAAddress()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if iaaddr.IPv6Addr.String() != "2001:db8::10" {
+		t.Fatalf("unexpected IPv6Addr: %v", iaaddr.IPv6Addr)
+	}
+}
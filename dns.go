@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/miekg/dns"
+)
+
+const dnsPort = 53
+
+// resolvConfPath is where upstream resolvers are read from for names this
+// process doesn't know about itself.
+const resolvConfPath = "/etc/resolv.conf"
+
+// dnsServerIPs returns the resolver addresses DHCPv4 (option 6) and RA
+// (RDNSS) should advertise to guests: this host's own embedded resolver,
+// listening on the same link-local address as the metadata server.
+func dnsServerIPs() []string {
+	return []string{metadataAddr}
+}
+
+// startDNSServer binds the embedded resolver to metadataAddr:53 on this
+// domain's tap device, alongside the metadata HTTP server.
+func (s *Server) startDNSServer() (net.PacketConn, error) {
+	lc := deviceListenConfig("tap" + s.name)
+	conn, err := lc.ListenPacket(context.Background(), "udp4", fmt.Sprintf("%s:%d", metadataAddr, dnsPort))
+	if err != nil {
+		return nil, err
+	}
+
+	srv := &dns.Server{PacketConn: conn, Handler: dns.HandlerFunc(dnsHandler)}
+	go func() {
+		if err := srv.ActivateAndServe(); err != nil && !s.shutdown {
+			glog.Errorf("%s dns server: %v", s.name, err)
+		}
+	}()
+
+	return conn, nil
+}
+
+func dnsHandler(w dns.ResponseWriter, r *dns.Msg) {
+	msg := new(dns.Msg)
+	msg.SetReply(r)
+
+	if len(r.Question) == 1 {
+		if rr := lookupGuestDomain(r.Question[0]); rr != nil {
+			msg.Answer = append(msg.Answer, rr)
+			w.WriteMsg(msg)
+			return
+		}
+	}
+
+	resp, err := forwardUpstream(r)
+	if err != nil {
+		glog.Errorf("dns forward: %v", err)
+		msg.SetRcode(r, dns.RcodeServerFailure)
+		w.WriteMsg(msg)
+		return
+	}
+	w.WriteMsg(resp)
+}
+
+// lookupGuestDomain answers q against the known libvirt domains, returning
+// an A/AAAA record for the first Host="true" address of the matching family,
+// or nil if q.Name isn't a known domain.
+func lookupGuestDomain(q dns.Question) dns.RR {
+	if q.Qtype != dns.TypeA && q.Qtype != dns.TypeAAAA {
+		return nil
+	}
+
+	name := strings.TrimSuffix(q.Name, ".")
+
+	serversMu.RLock()
+	s, ok := servers[name]
+	serversMu.RUnlock()
+	if !ok || s.metadata == nil {
+		return nil
+	}
+
+	family := "ipv4"
+	if q.Qtype == dns.TypeAAAA {
+		family = "ipv6"
+	}
+
+	for _, addr := range s.metadata.Network.IP {
+		if addr.Family != family || addr.Host != "true" {
+			continue
+		}
+		rr, err := dns.NewRR(fmt.Sprintf("%s 60 IN %s %s", q.Name, dns.TypeToString[q.Qtype], addr.Address))
+		if err != nil {
+			glog.Errorf("dns: build rr for %s: %v", name, err)
+			return nil
+		}
+		return rr
+	}
+	return nil
+}
+
+func forwardUpstream(r *dns.Msg) (*dns.Msg, error) {
+	conf, err := dns.ClientConfigFromFile(resolvConfPath)
+	if err != nil {
+		return nil, err
+	}
+
+	c := new(dns.Client)
+	var lastErr error
+	for _, server := range conf.Servers {
+		resp, _, err := c.Exchange(r, net.JoinHostPort(server, conf.Port))
+		if err == nil {
+			return resp, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func withTestServer(t *testing.T, name string, s *Server, fn func()) {
+	t.Helper()
+	serversMu.Lock()
+	prev, had := servers[name]
+	servers[name] = s
+	serversMu.Unlock()
+
+	defer func() {
+		serversMu.Lock()
+		if had {
+			servers[name] = prev
+		} else {
+			delete(servers, name)
+		}
+		serversMu.Unlock()
+	}()
+
+	fn()
+}
+
+func TestLookupGuestDomainA(t *testing.T) {
+	s := &Server{name: "vm1", metadata: &Metadata{Network: Network{IP: []IP{
+		{Family: "ipv4", Address: "192.0.2.10", Host: "true"},
+	}}}}
+
+	withTestServer(t, "vm1", s, func() {
+		rr := lookupGuestDomain(dns.Question{Name: "vm1.", Qtype: dns.TypeA})
+		if rr == nil {
+			t.Fatal("expected an A record, got nil")
+		}
+		a, ok := rr.(*dns.A)
+		if !ok || a.A.String() != "192.0.2.10" {
+			t.Fatalf("unexpected record: %v", rr)
+		}
+	})
+}
+
+func TestLookupGuestDomainUnknownName(t *testing.T) {
+	if rr := lookupGuestDomain(dns.Question{Name: "nope.", Qtype: dns.TypeA}); rr != nil {
+		t.Fatalf("expected nil for an unknown domain, got %v", rr)
+	}
+}
+
+func TestLookupGuestDomainWrongFamily(t *testing.T) {
+	s := &Server{name: "vm1", metadata: &Metadata{Network: Network{IP: []IP{
+		{Family: "ipv4", Address: "192.0.2.10", Host: "true"},
+	}}}}
+
+	withTestServer(t, "vm1", s, func() {
+		if rr := lookupGuestDomain(dns.Question{Name: "vm1.", Qtype: dns.TypeAAAA}); rr != nil {
+			t.Fatalf("expected nil when no ipv6 host address is configured, got %v", rr)
+		}
+	})
+}
+
+func TestLookupGuestDomainNotHostFacing(t *testing.T) {
+	s := &Server{name: "vm1", metadata: &Metadata{Network: Network{IP: []IP{
+		{Family: "ipv4", Address: "192.0.2.10", Host: "false"},
+	}}}}
+
+	withTestServer(t, "vm1", s, func() {
+		if rr := lookupGuestDomain(dns.Question{Name: "vm1.", Qtype: dns.TypeA}); rr != nil {
+			t.Fatalf("expected nil for a non-host-facing address, got %v", rr)
+		}
+	})
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// metadataAddr is the link-local address svirtnet binds on every tap device
+// to serve the EC2/cloud-init style metadata tree, the same way EC2 itself
+// exposes it inside every instance.
+const metadataAddr = "169.254.169.254"
+const metadataPort = 80
+
+var serversMu sync.RWMutex
+
+// serverForAddr returns the Server whose domain owns ip, read-locking a
+// snapshot of the servers map for the lookup.
+func serverForAddr(ip string) *Server {
+	serversMu.RLock()
+	defer serversMu.RUnlock()
+
+	for _, s := range servers {
+		if s.metadata == nil {
+			continue
+		}
+		for _, addr := range s.metadata.Network.IP {
+			if addr.Host == "true" && addr.Address == ip {
+				return s
+			}
+		}
+	}
+	return nil
+}
+
+// startMetadataServer binds the metadata HTTP endpoint to metadataAddr on
+// this domain's tap device and serves it until the listener is closed from
+// Server.Stop.
+func (s *Server) startMetadataServer() (net.Listener, error) {
+	lc := deviceListenConfig("tap" + s.name)
+	ln, err := lc.Listen(context.Background(), "tcp4", fmt.Sprintf("%s:%d", metadataAddr, metadataPort))
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		if err := http.Serve(ln, http.HandlerFunc(metadataHandler)); err != nil && !s.shutdown {
+			glog.Errorf("%s metadata server: %v", s.name, err)
+		}
+	}()
+
+	return ln, nil
+}
+
+func metadataHandler(w http.ResponseWriter, r *http.Request) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s := serverForAddr(host)
+	if s == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	s.serveMetadata(w, r)
+}
+
+func (s *Server) serveMetadata(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/latest")
+
+	switch {
+	case path == "/meta-data/" || path == "/meta-data":
+		keys := []string{"instance-id"}
+		if len(s.metadata.PublicKeys) > 0 {
+			keys = append(keys, "public-keys/")
+		}
+		fmt.Fprintln(w, strings.Join(keys, "\n"))
+
+	case path == "/meta-data/instance-id":
+		fmt.Fprint(w, s.name)
+
+	case path == "/meta-data/public-keys/" || path == "/meta-data/public-keys":
+		for i, key := range s.metadata.PublicKeys {
+			fmt.Fprintf(w, "%d=%s\n", i, key.Name)
+		}
+
+	case strings.HasPrefix(path, "/meta-data/public-keys/"):
+		s.serveMetadataPublicKey(w, r, strings.TrimPrefix(path, "/meta-data/public-keys/"))
+
+	case path == "/user-data":
+		s.serveMetadataUserData(w, r)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) serveMetadataPublicKey(w http.ResponseWriter, r *http.Request, rest string) {
+	i, err := publicKeyIndex(rest, len(s.metadata.PublicKeys))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	fmt.Fprint(w, s.metadata.PublicKeys[i].Value)
+}
+
+// publicKeyIndex parses the leading "<index>" segment of a
+// /latest/meta-data/public-keys/<index>/... request path and checks it
+// against count, the number of keys configured for the domain.
+func publicKeyIndex(rest string, count int) (int, error) {
+	idx := rest
+	if i := strings.Index(rest, "/"); i >= 0 {
+		idx = rest[:i]
+	}
+	i, err := strconv.Atoi(idx)
+	if err != nil {
+		return 0, err
+	}
+	if i < 0 || i >= count {
+		return 0, fmt.Errorf("public key index %d out of range [0,%d)", i, count)
+	}
+	return i, nil
+}
+
+func (s *Server) serveMetadataUserData(w http.ResponseWriter, r *http.Request) {
+	if s.metadata.CloudConfig.URL == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	resp, err := httpClient.Get(s.metadata.CloudConfig.URL)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
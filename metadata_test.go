@@ -0,0 +1,35 @@
+package main
+
+import "testing"
+
+func TestPublicKeyIndex(t *testing.T) {
+	cases := []struct {
+		rest    string
+		count   int
+		want    int
+		wantErr bool
+	}{
+		{rest: "0", count: 2, want: 0},
+		{rest: "1/openssh-key", count: 2, want: 1},
+		{rest: "2", count: 2, wantErr: true},
+		{rest: "-1", count: 2, wantErr: true},
+		{rest: "not-a-number", count: 2, wantErr: true},
+	}
+
+	for _, c := range cases {
+		got, err := publicKeyIndex(c.rest, c.count)
+		if c.wantErr {
+			if err == nil {
+				t.Errorf("publicKeyIndex(%q, %d): expected error, got %d", c.rest, c.count, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("publicKeyIndex(%q, %d): unexpected error: %v", c.rest, c.count, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("publicKeyIndex(%q, %d) = %d, want %d", c.rest, c.count, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+// Package netconf wraps the netlink operations svirtnet needs to wire up a
+// guest tap device: addresses, policy routes and proxy_arp. It exists so
+// Server.Start/Server.Stop no longer have to fork `ip` and `sysctl`.
+package netconf
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+
+	"github.com/vishvananda/netlink"
+)
+
+// RouteTable is the routing table svirtnet installs guest routes into.
+const RouteTable = 200
+
+// Rollback undoes a single change made by one of the Add* functions. It is
+// returned alongside the error-free result so callers can unwind partial
+// state if a later step in Server.Start fails.
+type Rollback func() error
+
+func linkByName(ifaceName string) (netlink.Link, error) {
+	link, err := netlink.LinkByName(ifaceName)
+	if err != nil {
+		return nil, fmt.Errorf("netconf: lookup link %s: %v", ifaceName, err)
+	}
+	return link, nil
+}
+
+// buildAddr parses cidr (and, if given, peer) into a netlink.Addr. peer, if
+// given, is itself a CIDR (e.g. "10.0.0.5/24") just like cidr; only its
+// address is used, paired with cidr's own mask.
+func buildAddr(cidr, peer string) (*netlink.Addr, error) {
+	ip, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("netconf: parse addr %s: %v", cidr, err)
+	}
+	ipNet.IP = ip
+
+	addr := &netlink.Addr{IPNet: ipNet}
+	if peer != "" {
+		peerIP, _, err := net.ParseCIDR(peer)
+		if err != nil {
+			return nil, fmt.Errorf("netconf: parse peer %s: %v", peer, err)
+		}
+		addr.Peer = &net.IPNet{IP: peerIP, Mask: ipNet.Mask}
+	}
+	return addr, nil
+}
+
+// AddAddr adds cidr to ifaceName, optionally as a peer address (point to
+// point), and returns a Rollback that removes it again.
+func AddAddr(ifaceName, cidr, peer string) (Rollback, error) {
+	link, err := linkByName(ifaceName)
+	if err != nil {
+		return nil, err
+	}
+
+	addr, err := buildAddr(cidr, peer)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := netlink.AddrAdd(link, addr); err != nil {
+		return nil, fmt.Errorf("netconf: add addr %s to %s: %v", cidr, ifaceName, err)
+	}
+
+	return func() error {
+		return netlink.AddrDel(link, addr)
+	}, nil
+}
+
+// DelAddr removes cidr from ifaceName.
+func DelAddr(ifaceName, cidr string) error {
+	link, err := linkByName(ifaceName)
+	if err != nil {
+		return err
+	}
+
+	ip, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return fmt.Errorf("netconf: parse addr %s: %v", cidr, err)
+	}
+	ipNet.IP = ip
+
+	return netlink.AddrDel(link, &netlink.Addr{IPNet: ipNet})
+}
+
+// AddRoute installs cidr as a route through ifaceName in table, returning a
+// Rollback that removes it again.
+func AddRoute(ifaceName, cidr string, table int) (Rollback, error) {
+	link, err := linkByName(ifaceName)
+	if err != nil {
+		return nil, err
+	}
+
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("netconf: parse route %s: %v", cidr, err)
+	}
+
+	route := &netlink.Route{LinkIndex: link.Attrs().Index, Dst: ipNet, Table: table}
+	if err := netlink.RouteReplace(route); err != nil {
+		return nil, fmt.Errorf("netconf: replace route %s dev %s table %d: %v", cidr, ifaceName, table, err)
+	}
+
+	return func() error {
+		return netlink.RouteDel(route)
+	}, nil
+}
+
+// DelRoute removes cidr from ifaceName in table.
+func DelRoute(ifaceName, cidr string, table int) error {
+	link, err := linkByName(ifaceName)
+	if err != nil {
+		return err
+	}
+
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return fmt.Errorf("netconf: parse route %s: %v", cidr, err)
+	}
+
+	return netlink.RouteDel(&netlink.Route{LinkIndex: link.Attrs().Index, Dst: ipNet, Table: table})
+}
+
+// SetProxyArp toggles net.ipv4.conf.<ifaceName>.proxy_arp via /proc/sys and
+// returns a Rollback that restores the previous value.
+func SetProxyArp(ifaceName string, enabled bool) (Rollback, error) {
+	path := fmt.Sprintf("/proc/sys/net/ipv4/conf/%s/proxy_arp", ifaceName)
+
+	prev, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("netconf: read %s: %v", path, err)
+	}
+
+	value := []byte("0\n")
+	if enabled {
+		value = []byte("1\n")
+	}
+	if err := ioutil.WriteFile(path, value, 0644); err != nil {
+		return nil, fmt.Errorf("netconf: write %s: %v", path, err)
+	}
+
+	return func() error {
+		return ioutil.WriteFile(path, prev, 0644)
+	}, nil
+}
+
+// Addrs returns the addresses currently configured on ifaceName, for use by
+// callers (such as cleanExists) that need to diff desired state against what
+// netlink already reports rather than parsing net.Interface.Addrs() strings.
+func Addrs(ifaceName string) ([]*net.IPNet, error) {
+	link, err := linkByName(ifaceName)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, fmt.Errorf("netconf: list addrs on %s: %v", ifaceName, err)
+	}
+
+	ret := make([]*net.IPNet, 0, len(addrs))
+	for _, a := range addrs {
+		ret = append(ret, a.IPNet)
+	}
+	return ret, nil
+}
@@ -0,0 +1,35 @@
+package netconf
+
+import "testing"
+
+func TestBuildAddrNoPeer(t *testing.T) {
+	addr, err := buildAddr("10.0.0.5/24", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if addr.Peer != nil {
+		t.Fatalf("expected no peer, got %v", addr.Peer)
+	}
+	if addr.IPNet.String() != "10.0.0.5/24" {
+		t.Fatalf("IPNet = %s, want 10.0.0.5/24", addr.IPNet)
+	}
+}
+
+func TestBuildAddrPeerCIDR(t *testing.T) {
+	addr, err := buildAddr("192.0.2.1/32", "10.0.0.5/24")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if addr.Peer == nil || addr.Peer.IP.String() != "10.0.0.5" {
+		t.Fatalf("Peer = %v, want 10.0.0.5", addr.Peer)
+	}
+	if addr.Peer.Mask.String() != addr.IPNet.Mask.String() {
+		t.Fatalf("Peer mask = %v, want local mask %v", addr.Peer.Mask, addr.IPNet.Mask)
+	}
+}
+
+func TestBuildAddrInvalidPeer(t *testing.T) {
+	if _, err := buildAddr("192.0.2.1/32", "not-an-address"); err == nil {
+		t.Fatal("expected an error for an invalid peer")
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/vishvananda/netlink"
+	"github.com/vtolstov/svirtnet/netconf"
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// overlayDevice is the shared WireGuard interface every domain's overlay
+// routes are added to. Unlike the per-guest tap devices, it is created once
+// per hypervisor and updated incrementally as domains start and stop.
+const overlayDevice = "wg0"
+
+var overlayMu sync.Mutex
+
+// overlayPeerDomains tracks, per peer public key, which domains contributed
+// which AllowedIPs, so Server.Stop can rebuild a peer's AllowedIPs without
+// the stopped domain without disturbing other VMs still routed through it.
+var overlayPeerDomains = make(map[wgtypes.Key]map[string][]net.IPNet)
+
+// overlayRouteRefs counts, per CIDR, how many domains currently need a
+// route for it through wg0, so the route is only installed once and only
+// removed once nothing references it any more.
+var overlayRouteRefs = make(map[string]int)
+var overlayRouteRollbacks = make(map[string]netconf.Rollback)
+
+// ensureOverlayDevice creates and brings up the shared wg0 device with a
+// fresh private key the first time any domain configures an overlay peer.
+// It is a no-op if wg0 already exists.
+func ensureOverlayDevice(client *wgctrl.Client) error {
+	if _, err := client.Device(overlayDevice); err == nil {
+		return nil
+	}
+
+	attrs := netlink.NewLinkAttrs()
+	attrs.Name = overlayDevice
+	link := &netlink.Wireguard{LinkAttrs: attrs}
+	if err := netlink.LinkAdd(link); err != nil && !os.IsExist(err) {
+		return fmt.Errorf("overlay: create %s: %v", overlayDevice, err)
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		return fmt.Errorf("overlay: bring up %s: %v", overlayDevice, err)
+	}
+
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		return fmt.Errorf("overlay: generate private key: %v", err)
+	}
+	return client.ConfigureDevice(overlayDevice, wgtypes.Config{PrivateKey: &key})
+}
+
+// addOverlayRoute installs cidr as a route through wg0 the first time it's
+// requested, and is a no-op (beyond bumping the refcount) afterwards.
+func addOverlayRoute(cidr string) error {
+	if overlayRouteRefs[cidr] > 0 {
+		overlayRouteRefs[cidr]++
+		return nil
+	}
+
+	rb, err := netconf.AddRoute(overlayDevice, cidr, netconf.RouteTable)
+	if err != nil {
+		return err
+	}
+	overlayRouteRefs[cidr] = 1
+	overlayRouteRollbacks[cidr] = rb
+	return nil
+}
+
+// delOverlayRoute drops a reference to cidr, removing the route once
+// nothing else needs it.
+func delOverlayRoute(cidr string) error {
+	if overlayRouteRefs[cidr] == 0 {
+		return nil
+	}
+	overlayRouteRefs[cidr]--
+	if overlayRouteRefs[cidr] > 0 {
+		return nil
+	}
+
+	rb := overlayRouteRollbacks[cidr]
+	delete(overlayRouteRefs, cidr)
+	delete(overlayRouteRollbacks, cidr)
+	if rb == nil {
+		return nil
+	}
+	return rb()
+}
+
+// hostAllowedIPs returns the ipv4/ipv6 host addresses this domain should
+// advertise into the overlay.
+func (s *Server) hostAllowedIPs() ([]net.IPNet, error) {
+	var ips []net.IPNet
+	for _, addr := range s.metadata.Network.IP {
+		if addr.Host != "true" {
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(addr.Address + "/" + addr.Prefix)
+		if err != nil {
+			return nil, fmt.Errorf("overlay: parse %s: %v", addr.Address+"/"+addr.Prefix, err)
+		}
+		ips = append(ips, *ipNet)
+	}
+	return ips, nil
+}
+
+// startOverlay wires this domain's addresses into the shared wg0 device's
+// peer AllowedIPs (so peer hypervisors know how to reach this VM) and
+// installs routes for each peer's own AllowedIPs through wg0 in
+// netconf.RouteTable (so this VM's traffic to *their* VMs goes over the
+// tunnel). It returns a Rollback that undoes both.
+func (s *Server) startOverlay() (netconf.Rollback, error) {
+	if len(s.metadata.Overlay.Peer) == 0 {
+		return func() error { return nil }, nil
+	}
+
+	hostIPs, err := s.hostAllowedIPs()
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := wgctrl.New()
+	if err != nil {
+		return nil, fmt.Errorf("overlay: %v", err)
+	}
+	defer client.Close()
+
+	if err := ensureOverlayDevice(client); err != nil {
+		return nil, err
+	}
+
+	overlayMu.Lock()
+	defer overlayMu.Unlock()
+
+	var configuredKeys []wgtypes.Key
+	var routedCIDRs []string
+
+	rollback := func() {
+		for _, key := range configuredKeys {
+			delete(overlayPeerDomains[key], s.name)
+		}
+		for _, cidr := range routedCIDRs {
+			if err := delOverlayRoute(cidr); err != nil {
+				glog.Errorf("%s overlay rollback route %s: %v", s.name, cidr, err)
+			}
+		}
+	}
+
+	for _, p := range s.metadata.Overlay.Peer {
+		key, peerCfg, err := parseOverlayPeer(p)
+		if err != nil {
+			rollback()
+			return nil, err
+		}
+		staticAllowedIPs := peerCfg.AllowedIPs
+
+		if overlayPeerDomains[key] == nil {
+			overlayPeerDomains[key] = make(map[string][]net.IPNet)
+		}
+		overlayPeerDomains[key][s.name] = hostIPs
+		configuredKeys = append(configuredKeys, key)
+
+		peerCfg.AllowedIPs = append(append([]net.IPNet{}, staticAllowedIPs...), mergeOverlayAllowedIPs(overlayPeerDomains[key])...)
+		peerCfg.ReplaceAllowedIPs = true
+
+		if err := client.ConfigureDevice(overlayDevice, wgtypes.Config{Peers: []wgtypes.PeerConfig{peerCfg}}); err != nil {
+			rollback()
+			return nil, fmt.Errorf("overlay: configure peer %s: %v", key, err)
+		}
+
+		for _, ipNet := range staticAllowedIPs {
+			cidr := ipNet.String()
+			if err := addOverlayRoute(cidr); err != nil {
+				rollback()
+				return nil, fmt.Errorf("overlay: add route %s: %v", cidr, err)
+			}
+			routedCIDRs = append(routedCIDRs, cidr)
+		}
+	}
+
+	return func() error {
+		return s.stopOverlay()
+	}, nil
+}
+
+// stopOverlay removes this domain's AllowedIPs from every overlay peer it
+// was added to and drops this domain's references on those peers' routes,
+// leaving other domains' entries and routes still in use untouched.
+func (s *Server) stopOverlay() error {
+	if s.metadata == nil || len(s.metadata.Overlay.Peer) == 0 {
+		return nil
+	}
+
+	client, err := wgctrl.New()
+	if err != nil {
+		return fmt.Errorf("overlay: %v", err)
+	}
+	defer client.Close()
+
+	overlayMu.Lock()
+	defer overlayMu.Unlock()
+
+	for _, p := range s.metadata.Overlay.Peer {
+		key, peerCfg, err := parseOverlayPeer(p)
+		if err != nil {
+			glog.Errorf("%s overlay stop: %v", s.name, err)
+			continue
+		}
+		staticAllowedIPs := peerCfg.AllowedIPs
+
+		domains := overlayPeerDomains[key]
+		if domains != nil {
+			delete(domains, s.name)
+		}
+
+		peerCfg.AllowedIPs = append(append([]net.IPNet{}, staticAllowedIPs...), mergeOverlayAllowedIPs(domains)...)
+		peerCfg.ReplaceAllowedIPs = true
+
+		if err := client.ConfigureDevice(overlayDevice, wgtypes.Config{Peers: []wgtypes.PeerConfig{peerCfg}}); err != nil {
+			glog.Errorf("%s overlay stop: configure peer %s: %v", s.name, key, err)
+		}
+
+		for _, ipNet := range staticAllowedIPs {
+			if err := delOverlayRoute(ipNet.String()); err != nil {
+				glog.Errorf("%s overlay stop: del route %s: %v", s.name, ipNet.String(), err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func mergeOverlayAllowedIPs(domains map[string][]net.IPNet) []net.IPNet {
+	var merged []net.IPNet
+	for _, ips := range domains {
+		merged = append(merged, ips...)
+	}
+	return merged
+}
+
+func parseOverlayPeer(p OverlayPeer) (wgtypes.Key, wgtypes.PeerConfig, error) {
+	key, err := wgtypes.ParseKey(p.PublicKey)
+	if err != nil {
+		return key, wgtypes.PeerConfig{}, fmt.Errorf("overlay: parse peer key %s: %v", p.PublicKey, err)
+	}
+
+	cfg := wgtypes.PeerConfig{PublicKey: key}
+
+	if p.Endpoint != "" {
+		endpoint, err := net.ResolveUDPAddr("udp", p.Endpoint)
+		if err != nil {
+			return key, cfg, fmt.Errorf("overlay: resolve endpoint %s: %v", p.Endpoint, err)
+		}
+		cfg.Endpoint = endpoint
+	}
+
+	for _, cidr := range strings.Split(p.AllowedIPs, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return key, cfg, fmt.Errorf("overlay: parse allowed-ips %s: %v", cidr, err)
+		}
+		cfg.AllowedIPs = append(cfg.AllowedIPs, *ipNet)
+	}
+
+	return key, cfg, nil
+}
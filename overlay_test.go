@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseOverlayPeer(t *testing.T) {
+	p := OverlayPeer{
+		PublicKey:  "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAE=",
+		Endpoint:   "198.51.100.1:51820",
+		AllowedIPs: "10.0.1.0/24, 2001:db8:1::/64",
+	}
+
+	key, cfg, err := parseOverlayPeer(p)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if key.String() != p.PublicKey {
+		t.Fatalf("PublicKey = %s, want %s", key.String(), p.PublicKey)
+	}
+	if cfg.Endpoint == nil || cfg.Endpoint.String() != "198.51.100.1:51820" {
+		t.Fatalf("Endpoint = %v, want 198.51.100.1:51820", cfg.Endpoint)
+	}
+	if len(cfg.AllowedIPs) != 2 {
+		t.Fatalf("AllowedIPs = %v, want 2 entries", cfg.AllowedIPs)
+	}
+}
+
+func TestParseOverlayPeerInvalidKey(t *testing.T) {
+	if _, _, err := parseOverlayPeer(OverlayPeer{PublicKey: "not-a-key"}); err == nil {
+		t.Fatal("expected an error for an invalid public key")
+	}
+}
+
+func TestMergeOverlayAllowedIPs(t *testing.T) {
+	_, a, _ := net.ParseCIDR("10.0.1.0/24")
+	_, b, _ := net.ParseCIDR("10.0.2.0/24")
+
+	merged := mergeOverlayAllowedIPs(map[string][]net.IPNet{
+		"vm1": {*a},
+		"vm2": {*b},
+	})
+
+	if len(merged) != 2 {
+		t.Fatalf("expected 2 merged entries, got %d: %v", len(merged), merged)
+	}
+}
+
+func TestMergeOverlayAllowedIPsEmpty(t *testing.T) {
+	if merged := mergeOverlayAllowedIPs(nil); len(merged) != 0 {
+		t.Fatalf("expected no entries, got %v", merged)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+
+	"code.google.com/p/go.net/ipv6"
+	"github.com/golang/glog"
+)
+
+const (
+	icmpv6RouterSolicit = 133
+	icmpv6RouterAdvert  = 134
+
+	raOptSourceLinkAddr = 1
+	raOptRDNSS          = 25
+
+	raFlagManaged = 0x80
+	raFlagOther   = 0x40
+
+	raRDNSSLifetime = 2 * raInterval
+
+	raRouterLifetime = 1800 * time.Second
+	raInterval       = 10 * time.Second
+)
+
+// ListenAndServeICMPv6 answers Router Solicitations and periodically emits
+// unsolicited Router Advertisements on this guest's tap device. The
+// Managed/Other flags are set whenever this domain has a DHCPv6 address
+// configured, so guests know to follow up with DHCPv6 instead of relying on
+// SLAAC alone.
+func (s *Server) ListenAndServeICMPv6() error {
+	ifi, err := net.InterfaceByName("tap" + s.name)
+	if err != nil {
+		return err
+	}
+
+	c, err := net.ListenPacket("ip6:ipv6-icmp", "::")
+	if err != nil {
+		return err
+	}
+	if err := bindToDevice(c, "tap"+s.name); err != nil {
+		c.Close()
+		return err
+	}
+
+	pc := ipv6.NewPacketConn(c)
+	allRouters := &net.IPAddr{IP: net.ParseIP("ff02::2"), Zone: ifi.Name}
+	if err := pc.JoinGroup(ifi, allRouters); err != nil {
+		c.Close()
+		return err
+	}
+
+	s.Lock()
+	s.ipv6conn = pc
+	s.Unlock()
+
+	go s.sendPeriodicRA(pc, ifi)
+
+	buf := make([]byte, 1500)
+	for {
+		n, _, src, err := pc.ReadFrom(buf)
+		if err != nil {
+			if s.shutdown {
+				return nil
+			}
+			glog.Errorf("%s ra read: %v", s.name, err)
+			continue
+		}
+		if n < 1 || buf[0] != icmpv6RouterSolicit {
+			continue
+		}
+
+		if _, err := pc.WriteTo(s.buildRA(ifi), nil, src); err != nil {
+			glog.Errorf("%s ra reply: %v", s.name, err)
+		}
+	}
+}
+
+func (s *Server) sendPeriodicRA(pc *ipv6.PacketConn, ifi *net.Interface) {
+	allNodes := &net.IPAddr{IP: net.ParseIP("ff02::1"), Zone: ifi.Name}
+	ticker := time.NewTicker(raInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if s.shutdown {
+			return
+		}
+		if _, err := pc.WriteTo(s.buildRA(ifi), nil, allNodes); err != nil {
+			glog.Errorf("%s ra periodic: %v", s.name, err)
+		}
+	}
+}
+
+// buildRA assembles a Router Advertisement with a source link-layer address
+// option, setting the Managed/Other flags when s.dhcpv6Addr() reports a
+// DHCPv6 address for this domain. An RDNSS option is only included when
+// dnsServerIPv6List() has an actual IPv6-reachable resolver to advertise:
+// the embedded resolver currently only listens on udp4, so there is nothing
+// genuine to offer SLAAC-only guests yet.
+func (s *Server) buildRA(ifi *net.Interface) []byte {
+	var flags byte
+	if s.dhcpv6Addr() != nil {
+		flags |= raFlagManaged | raFlagOther
+	}
+
+	ra := make([]byte, 16)
+	ra[0] = icmpv6RouterAdvert
+	ra[1] = 0 // code
+	// ra[2:4] checksum is filled in by the kernel for ip6:ipv6-icmp sockets.
+	ra[4] = 64 // cur hop limit
+	ra[5] = flags
+	binary.BigEndian.PutUint16(ra[6:8], uint16(raRouterLifetime.Seconds()))
+	binary.BigEndian.PutUint32(ra[8:12], 0)  // reachable time: unspecified
+	binary.BigEndian.PutUint32(ra[12:16], 0) // retrans timer: unspecified
+
+	ra = append(ra, sourceLinkLayerOption(ifi.HardwareAddr)...)
+
+	if dns := dnsServerIPv6List(); len(dns) > 0 {
+		ra = append(ra, rdnssOption(dns)...)
+	}
+
+	return ra
+}
+
+// dnsServerIPv6List parses dnsServerIPs() into the subset that are genuine
+// IPv6 addresses, for use with the RA's RDNSS option. A v4-mapped address
+// like the embedded resolver's current address would decode without error
+// but isn't reachable over IPv6, so it's deliberately excluded rather than
+// embedded via To16().
+func dnsServerIPv6List() []net.IP {
+	var ips []net.IP
+	for _, addr := range dnsServerIPs() {
+		ip := net.ParseIP(addr)
+		if ip == nil || ip.To4() != nil {
+			continue
+		}
+		ips = append(ips, ip)
+	}
+	return ips
+}
+
+func sourceLinkLayerOption(mac net.HardwareAddr) []byte {
+	opt := make([]byte, 8)
+	opt[0] = raOptSourceLinkAddr
+	opt[1] = 1 // length in units of 8 bytes
+	copy(opt[2:], mac)
+	return opt
+}
+
+// rdnssOption builds the RDNSS option (RFC 8106) advertising addrs as
+// recursive DNS servers.
+func rdnssOption(addrs []net.IP) []byte {
+	lengthUnits := 1 + len(addrs)*2 // 1 header unit + 2 units (16 bytes) per address
+	opt := make([]byte, 8*lengthUnits)
+	opt[0] = raOptRDNSS
+	opt[1] = byte(lengthUnits)
+	binary.BigEndian.PutUint32(opt[4:8], uint32(raRDNSSLifetime.Seconds()))
+
+	for i, addr := range addrs {
+		copy(opt[8+i*16:], addr.To16())
+	}
+	return opt
+}
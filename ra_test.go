@@ -0,0 +1,9 @@
+package main
+
+import "testing"
+
+func TestDnsServerIPv6ListExcludesV4(t *testing.T) {
+	if ips := dnsServerIPv6List(); len(ips) != 0 {
+		t.Fatalf("expected no IPv6-reachable resolvers (dnsServerIPs is v4-only), got %v", ips)
+	}
+}
@@ -6,11 +6,8 @@ import (
 	"fmt"
 	"net"
 	"net/http"
-	"os/exec"
-	"reflect"
 	"strings"
 	"sync"
-	"syscall"
 	"time"
 
 	"crypto/tls"
@@ -19,6 +16,7 @@ import (
 	"code.google.com/p/go.net/ipv6"
 	"github.com/alexzorin/libvirt-go"
 	"github.com/golang/glog"
+	"github.com/vtolstov/svirtnet/netconf"
 )
 
 type IP struct {
@@ -43,9 +41,26 @@ type Network struct {
 	IP []IP `xml:"ip"`
 }
 
+type PublicKey struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:",chardata"`
+}
+
+type OverlayPeer struct {
+	PublicKey  string `xml:"public-key,attr"`
+	Endpoint   string `xml:"endpoint,attr,omitempty"`
+	AllowedIPs string `xml:"allowed-ips,attr,omitempty"`
+}
+
+type Overlay struct {
+	Peer []OverlayPeer `xml:"peer"`
+}
+
 type Metadata struct {
 	Network     Network     `xml:"network"`
 	CloudConfig CloudConfig `xml:"cloud-config"`
+	PublicKeys  []PublicKey `xml:"public-keys>public-key,omitempty"`
+	Overlay     Overlay     `xml:"overlay,omitempty"`
 }
 
 var httpconn net.Listener
@@ -60,12 +75,25 @@ type Server struct {
 	// domain metadata
 	metadata *Metadata
 
+	// this hypervisor's own routable address, used as the DHCPv4 server
+	// identifier and IP source for replies
+	hostIP net.IP
+
 	// DHCPv4 conn
 	ipv4conn *ipv4.RawConn
 
+	// DHCPv6 conn
+	ipv6dhcpconn *net.UDPConn
+
 	// RA conn
 	ipv6conn *ipv6.PacketConn
 
+	// metadata HTTP listener
+	metadataListener net.Listener
+
+	// embedded DNS resolver conn
+	dnsConn net.PacketConn
+
 	// Libvirt conn
 	libvirt libvirt.VirConnection
 
@@ -80,17 +108,20 @@ var httpTransport *http.Transport = &http.Transport{
 var httpClient *http.Client = &http.Client{Transport: httpTransport, Timeout: 10 * time.Second}
 
 func cleanExists(name string, ips []IP) []IP {
-	ret := make([]IP, len(ips))
-	copy(ret[:], ips[:])
-
-	iface, err := net.InterfaceByName("tap" + name)
-	if err != nil {
-		return ips
-	}
-	addrs, err := iface.Addrs()
+	addrs, err := netconf.Addrs("tap" + name)
 	if err != nil {
 		return ips
 	}
+	return cleanExistsAddrs(ips, addrs)
+}
+
+// cleanExistsAddrs drops any entry of ips that is already present in addrs,
+// as reported by netlink, so Server.Start doesn't try to re-add an address
+// that already exists on the tap device.
+func cleanExistsAddrs(ips []IP, addrs []*net.IPNet) []IP {
+	ret := make([]IP, len(ips))
+	copy(ret[:], ips[:])
+
 	for _, addr := range addrs {
 	loop:
 		for i, ip := range ret {
@@ -150,7 +181,6 @@ func (s *Server) Start() error {
 		return err
 	}
 	var peer string
-	var cmd *exec.Cmd
 	for _, addr := range addrs {
 		a := strings.Split(addr.String(), "/")[0]
 		ip := net.ParseIP(a)
@@ -161,52 +191,101 @@ func (s *Server) Start() error {
 			peer = ip.String()
 		}
 	}
+	s.hostIP = net.ParseIP(peer)
 
 	metaIP := cleanExists(s.name, s.metadata.Network.IP)
 
+	var rollbacks []netconf.Rollback
+	undo := func() {
+		for i := len(rollbacks) - 1; i >= 0; i-- {
+			if rerr := rollbacks[i](); rerr != nil {
+				glog.Errorf("%s rollback failed: %v", s.name, rerr)
+			}
+		}
+	}
+
 	for _, addr := range metaIP {
 		if addr.Family == "ipv4" && addr.Host == "true" {
-			// TODO: use netlink
+			var rb netconf.Rollback
+			var err error
 			if addr.Peer != "" {
-				cmd = exec.Command("ip", "-4", "a", "add", peer, "peer", addr.Address+"/"+addr.Prefix, "dev", "tap"+s.name)
+				// Point to point: the tap's own local address is the host's
+				// routable address, and the guest's metadata address is the peer.
+				rb, err = netconf.AddAddr("tap"+s.name, peer+"/32", addr.Address+"/"+addr.Prefix)
 			} else {
-				cmd = exec.Command("ip", "-4", "a", "add", addr.Address+"/"+addr.Prefix, "dev", "tap"+s.name)
+				rb, err = netconf.AddAddr("tap"+s.name, addr.Address+"/"+addr.Prefix, "")
 			}
-			err = cmd.Run()
 			if err != nil {
-				return fmt.Errorf("Failed to add ip for: %s", addr.Address+"/"+addr.Prefix)
+				undo()
+				return fmt.Errorf("Failed to add ip for: %s: %v", addr.Address+"/"+addr.Prefix, err)
 			}
+			rollbacks = append(rollbacks, rb)
 		}
 	}
 
-	cmd = exec.Command("sysctl", "-w", "net.ipv4.conf.tap"+s.name+".proxy_arp=1")
-	aa, err := cmd.CombinedOutput()
+	rb, err := netconf.SetProxyArp("tap"+s.name, true)
 	if err != nil {
-		return fmt.Errorf("Failed to enable proxy_arp: %s sysctl -w net.ipv4.conf.tap%s.proxy_arp=1", aa, s.name)
+		undo()
+		return fmt.Errorf("Failed to enable proxy_arp on tap%s: %v", s.name, err)
 	}
-
-	defer s.Unlock()
-
-	glog.Infof("%s ListenAndServeUDPv4\n", s.name)
-	go s.ListenAndServeUDPv4()
+	rollbacks = append(rollbacks, rb)
 
 	for _, addr := range metaIP {
 		if addr.Family == "ipv6" && addr.Host == "true" {
-			// TODO: use netlink
-			cmd := exec.Command("ip", "-6", "a", "add", addr.Address+"/"+addr.Prefix, "dev", "tap"+s.name)
-			err = cmd.Run()
+			rb, err := netconf.AddAddr("tap"+s.name, addr.Address+"/"+addr.Prefix, "")
 			if err != nil {
-				return fmt.Errorf("Failed to add ip for: %s", addr.Address+"/"+addr.Prefix)
+				undo()
+				return fmt.Errorf("Failed to add ip for: %s: %v", addr.Address+"/"+addr.Prefix, err)
 			}
+			rollbacks = append(rollbacks, rb)
 
-			cmd = exec.Command("ip", "-6", "r", "replace", addr.Address+"/"+addr.Prefix, "dev", "tap"+s.name, "proto", "static", "table", "200")
-			err = cmd.Run()
+			rb, err = netconf.AddRoute("tap"+s.name, addr.Address+"/"+addr.Prefix, netconf.RouteTable)
 			if err != nil {
-				return fmt.Errorf("Failed to replace route for: %s", addr.Address+"/"+addr.Prefix)
+				undo()
+				return fmt.Errorf("Failed to replace route for: %s: %v", addr.Address+"/"+addr.Prefix, err)
 			}
+			rollbacks = append(rollbacks, rb)
 		}
 	}
 
+	rb, err = netconf.AddAddr("tap"+s.name, metadataAddr+"/32", "")
+	if err != nil {
+		undo()
+		return fmt.Errorf("Failed to add metadata address to tap%s: %v", s.name, err)
+	}
+	rollbacks = append(rollbacks, rb)
+
+	ln, err := s.startMetadataServer()
+	if err != nil {
+		undo()
+		return fmt.Errorf("Failed to start metadata server for tap%s: %v", s.name, err)
+	}
+	s.metadataListener = ln
+
+	dnsConn, err := s.startDNSServer()
+	if err != nil {
+		undo()
+		return fmt.Errorf("Failed to start dns server for tap%s: %v", s.name, err)
+	}
+	s.dnsConn = dnsConn
+
+	rb, err = s.startOverlay()
+	if err != nil {
+		undo()
+		return fmt.Errorf("Failed to start overlay for %s: %v", s.name, err)
+	}
+	rollbacks = append(rollbacks, rb)
+
+	defer s.Unlock()
+
+	glog.Infof("%s ListenAndServeUDPv4\n", s.name)
+	go s.ListenAndServeUDPv4()
+
+	if s.dhcpv6Addr() != nil {
+		glog.Infof("%s ListenAndServeUDPv6\n", s.name)
+		go s.ListenAndServeUDPv6()
+	}
+
 	glog.Infof("%s ListenAndServeICMPv6\n", s.name)
 	go s.ListenAndServeICMPv6()
 
@@ -238,59 +317,64 @@ func (s *Server) Stop() (err error) {
 			return err
 		}
 	}
+	if s.ipv6dhcpconn != nil {
+		err = s.ipv6dhcpconn.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if s.metadataListener != nil {
+		err = s.metadataListener.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if s.dnsConn != nil {
+		err = s.dnsConn.Close()
+		if err != nil {
+			return err
+		}
+	}
 
 	if s.metadata == nil {
 		return nil
 	}
 
 	for _, addr := range s.metadata.Network.IP {
-		if addr.Family == "ipv6" && addr.Host == "true" {
-			/*
-				iface, err := net.InterfaceByName("tap" + s.name)
-				if err != nil {
-					return err
-				}
-				ip, net, err := net.ParseCIDR(addr.Address + "1/" + addr.Prefix)
-				if err != nil {
-					return err
-				}
-				err = netlink.NetworkLinkAddIp(iface, ip, net)
-				if err != nil {
-					return err
-				}
-			*/
-			// TODO: use netlink
-			cmd := exec.Command("ip", "-6", "r", "del", addr.Address+"/"+addr.Prefix, "dev", "tap"+s.name, "proto", "static", "table", "200")
-			err = cmd.Run()
-			if err != nil {
+		if addr.Host != "true" {
+			continue
+		}
+
+		cidr := addr.Address + "/" + addr.Prefix
+
+		if addr.Family == "ipv6" {
+			if err = netconf.DelRoute("tap"+s.name, cidr, netconf.RouteTable); err != nil {
 				return err
 			}
 		}
+
+		if addr.Family == "ipv4" && addr.Peer != "" {
+			// Point to point: Start configured the tap's own local address
+			// as the host's routable address, with this address as the peer.
+			cidr = s.hostIP.String() + "/32"
+		}
+
+		if err = netconf.DelAddr("tap"+s.name, cidr); err != nil {
+			return err
+		}
 	}
 
-	return nil
-}
+	if err = netconf.DelAddr("tap"+s.name, metadataAddr+"/32"); err != nil {
+		return err
+	}
 
-func bindToDevice(conn net.PacketConn, device string) error {
-	ptrVal := reflect.ValueOf(conn)
-	val := reflect.Indirect(ptrVal)
-	//next line will get you the net.netFD
-	fdmember := val.FieldByName("fd")
-	val1 := reflect.Indirect(fdmember)
-	netFdPtr := val1.FieldByName("sysfd")
-	fd := int(netFdPtr.Int())
-	//fd now has the actual fd for the socket
-	return syscall.SetsockoptString(fd, syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, device)
-}
+	if _, err = netconf.SetProxyArp("tap"+s.name, false); err != nil {
+		return err
+	}
 
-func bindToDevice2(conn *net.TCPListener, device string) error {
-	ptrVal := reflect.ValueOf(conn)
-	val := reflect.Indirect(ptrVal)
-	//next line will get you the net.netFD
-	fdmember := val.FieldByName("fd")
-	val1 := reflect.Indirect(fdmember)
-	netFdPtr := val1.FieldByName("sysfd")
-	fd := int(netFdPtr.Int())
-	//fd now has the actual fd for the socket
-	return syscall.SetsockoptString(fd, syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, device)
+	if err = s.stopOverlay(); err != nil {
+		return err
+	}
+
+	return nil
 }
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func mustParseIPNet(t *testing.T, cidr string) *net.IPNet {
+	t.Helper()
+	ip, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		t.Fatalf("ParseCIDR(%q): %v", cidr, err)
+	}
+	// Keep the host address, as netlink reports it, not the network address.
+	ipNet.IP = ip
+	return ipNet
+}
+
+func TestCleanExistsAddrsRemovesConfigured(t *testing.T) {
+	ips := []IP{
+		{Family: "ipv4", Address: "192.0.2.10", Prefix: "24"},
+		{Family: "ipv4", Address: "192.0.2.11", Prefix: "24"},
+	}
+	addrs := []*net.IPNet{mustParseIPNet(t, "192.0.2.10/24")}
+
+	got := cleanExistsAddrs(ips, addrs)
+
+	if len(got) != 1 || got[0].Address != "192.0.2.11" {
+		t.Fatalf("expected only 192.0.2.11 to remain, got %+v", got)
+	}
+}
+
+func TestCleanExistsAddrsNoneConfigured(t *testing.T) {
+	ips := []IP{{Family: "ipv4", Address: "192.0.2.10", Prefix: "24"}}
+
+	got := cleanExistsAddrs(ips, nil)
+
+	if len(got) != 1 {
+		t.Fatalf("expected input unchanged, got %+v", got)
+	}
+}
+
+func TestCleanExistsAddrsDoesNotMutateInput(t *testing.T) {
+	ips := []IP{
+		{Family: "ipv4", Address: "192.0.2.10", Prefix: "24"},
+		{Family: "ipv4", Address: "192.0.2.11", Prefix: "24"},
+	}
+	addrs := []*net.IPNet{mustParseIPNet(t, "192.0.2.10/24")}
+
+	cleanExistsAddrs(ips, addrs)
+
+	if len(ips) != 2 || ips[0].Address != "192.0.2.10" || ips[1].Address != "192.0.2.11" {
+		t.Fatalf("expected caller's slice to be left untouched, got %+v", ips)
+	}
+}